@@ -1,6 +1,16 @@
 package scram_test
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
 	"testing"
 
 	"github.com/globalsign/mgo/internal/scram"
@@ -17,11 +27,376 @@ func (s *S) TestNewMethod(c *C) {
 	var err error
 
 	_, err = scram.NewMethod("SCRAM-SHA-1")
-	c.Assert(err, Equals, IsNil)
+	c.Assert(err, IsNil)
 
 	_, err = scram.NewMethod("SCRAM-SHA-256")
 	c.Assert(err, IsNil)
 
+	_, err = scram.NewMethod("SCRAM-SHA-1-PLUS")
+	c.Assert(err, IsNil)
+
+	_, err = scram.NewMethod("SCRAM-SHA-256-PLUS")
+	c.Assert(err, IsNil)
+
 	_, err = scram.NewMethod("example")
 	c.Assert(err, NotNil)
 }
+
+func (s *S) TestMethodChannelBinding(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-1")
+	c.Assert(err, IsNil)
+	c.Assert(m.ChannelBinding(), Equals, false)
+
+	m, err = scram.NewMethod("SCRAM-SHA-256-PLUS")
+	c.Assert(err, IsNil)
+	c.Assert(m.ChannelBinding(), Equals, true)
+}
+
+func (s *S) TestNewClientRejectsPlusMethod(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-256-PLUS")
+	c.Assert(err, IsNil)
+
+	_, err = scram.NewClient(m, "user", "pass")
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestNewClientWithChannelBindingRejectsNonPlusMethod(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-256")
+	c.Assert(err, IsNil)
+
+	_, err = scram.NewClientWithChannelBinding(m, "user", "pass", "tls-server-end-point", []byte("x"))
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestNewClientWithChannelBindingRejectsUnknownType(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-256-PLUS")
+	c.Assert(err, IsNil)
+
+	_, err = scram.NewClientWithChannelBinding(m, "user", "pass", "tls-unique", []byte("x"))
+	c.Assert(err, NotNil)
+}
+
+// mongoPasswordDigestForTest reimplements the hex(md5(user+":mongo:"+pass))
+// digest scram.NewClient is expected to use as the SASL password for
+// SCRAM-SHA-1, so the test below can key a fake server on it independently
+// of the package's own (unexported) implementation.
+func mongoPasswordDigestForTest(user, pass string) string {
+	h := md5.New()
+	h.Write([]byte(user + ":mongo:" + pass))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *S) TestNewClientSha1UsesMongoDigest(c *C) {
+	const user, pass = "user", "pass"
+
+	m, err := scram.NewMethod("SCRAM-SHA-1")
+	c.Assert(err, IsNil)
+
+	runConversation := func(server *fakeServer) error {
+		client, err := scram.NewClient(m, user, pass)
+		c.Assert(err, IsNil)
+
+		out, ok, err := client.Step(nil)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		serverFirst, err := server.firstResponse(string(out))
+		c.Assert(err, IsNil)
+
+		out, ok, err = client.Step([]byte(serverFirst))
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		serverFinal, err := server.finalResponse(string(out))
+		c.Assert(err, IsNil)
+
+		_, _, err = client.Step([]byte(serverFinal))
+		return err
+	}
+
+	c.Log("authenticates against a server keyed on the MongoDB password digest")
+	digestServer := newFakeServerForHash(sha1.New, mongoPasswordDigestForTest(user, pass))
+	c.Assert(runConversation(digestServer), IsNil)
+
+	c.Log("does not authenticate against a server keyed on the raw password")
+	rawServer := newFakeServerForHash(sha1.New, pass)
+	c.Assert(runConversation(rawServer), NotNil)
+}
+
+func (s *S) TestNewClientWithMinIterations(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-256")
+	c.Assert(err, IsNil)
+
+	client, err := scram.NewClient(m, "user", "pass", scram.WithMinIterations(10000))
+	c.Assert(err, IsNil)
+	c.Assert(client, NotNil)
+
+	c.Log("rejects a server that offers fewer than the minimum iterations")
+	server := newFakeServer("pass")
+	server.iters = 100
+
+	out, ok, err := client.Step(nil)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	serverFirst, err := server.firstResponse(string(out))
+	c.Assert(err, IsNil)
+
+	_, _, err = client.Step([]byte(serverFirst))
+	c.Assert(err, ErrorMatches, ".*too few iterations.*")
+}
+
+func (s *S) TestFirstStep(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-256")
+	c.Assert(err, IsNil)
+
+	client, err := scram.NewClient(m, "user", "pass")
+	c.Assert(err, IsNil)
+
+	out, err := client.FirstStep()
+	c.Assert(err, IsNil)
+	c.Assert(len(out) > 0, Equals, true)
+	c.Assert(string(out[:3]), Equals, "n,,")
+}
+
+// fakeServer drives a minimal SCRAM server side of the conversation against
+// a known SASL password, so Client.Step can be exercised end to end
+// without a real mongod. The SASL password is whatever the corresponding
+// Client was constructed with: the raw password for SCRAM-SHA-256, or the
+// MongoDB digest (see mongoPasswordDigestForTest) for SCRAM-SHA-1.
+type fakeServer struct {
+	newHash func() hash.Hash
+	pass    []byte
+	salt    []byte
+	iters   int
+
+	// expectCBind, when set, is the gs2-header-plus-binding-data the
+	// server requires the client-final message's "c=" attribute to
+	// decode to; finalResponse fails the conversation if it doesn't.
+	expectCBind []byte
+
+	clientFirstBare string
+	serverFirst     string
+}
+
+// newFakeServer returns a fake SCRAM-SHA-256 server keyed on the SASL
+// password sasPass.
+func newFakeServer(sasPass string) *fakeServer {
+	return newFakeServerForHash(sha256.New, sasPass)
+}
+
+func newFakeServerForHash(newHash func() hash.Hash, sasPass string) *fakeServer {
+	return &fakeServer{newHash: newHash, pass: []byte(sasPass), salt: []byte("0102030405060708"), iters: 4096}
+}
+
+func (f *fakeServer) firstResponse(clientFirst string) (string, error) {
+	i := strings.Index(clientFirst, ",,")
+	if i < 0 {
+		return "", fmt.Errorf("malformed client-first-message: %q", clientFirst)
+	}
+	f.clientFirstBare = clientFirst[i+2:]
+
+	var nonce string
+	for _, field := range strings.Split(f.clientFirstBare, ",") {
+		if strings.HasPrefix(field, "r=") {
+			nonce = field[2:]
+		}
+	}
+	if nonce == "" {
+		return "", fmt.Errorf("client-first-message has no nonce: %q", clientFirst)
+	}
+
+	f.serverFirst = fmt.Sprintf("r=%sserver,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(f.salt), f.iters)
+	return f.serverFirst, nil
+}
+
+// finalResponse returns the server's "v=" verifier for clientFinal, the
+// client-final-message produced in response to firstResponse's output.
+func (f *fakeServer) finalResponse(clientFinal string) (string, error) {
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", fmt.Errorf("malformed client-final-message: %q", clientFinal)
+	}
+
+	if f.expectCBind != nil {
+		cbind, err := decodeCBind(clientFinal)
+		if err != nil {
+			return "", err
+		}
+		if !bytes.Equal(cbind, f.expectCBind) {
+			return "", fmt.Errorf("channel binding mismatch: got %q, want %q", cbind, f.expectCBind)
+		}
+	}
+
+	keyLen := f.newHash().Size()
+	saltedPassword := pbkdf2Hash(f.newHash, f.pass, f.salt, f.iters, keyLen)
+	serverKey := hmacHash(f.newHash, saltedPassword, []byte("Server Key"))
+	authMessage := f.clientFirstBare + "," + f.serverFirst + "," + clientFinal[:i]
+	serverSignature := hmacHash(f.newHash, serverKey, []byte(authMessage))
+	return "v=" + base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// decodeCBind extracts and base64-decodes clientFinal's "c=" attribute.
+func decodeCBind(clientFinal string) ([]byte, error) {
+	i := strings.Index(clientFinal, "c=")
+	if i < 0 {
+		return nil, fmt.Errorf("client-final-message has no c= attribute: %q", clientFinal)
+	}
+	rest := clientFinal[i+2:]
+	if j := strings.IndexByte(rest, ','); j >= 0 {
+		rest = rest[:j]
+	}
+	return base64.StdEncoding.DecodeString(rest)
+}
+
+func hmacHash(newHash func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2Hash is a minimal PBKDF2 (RFC 8018) implementation over the given
+// HMAC hash, just enough to derive the salted password fakeServer needs;
+// the client side gets its own PBKDF2 from xdg-go/scram.
+func pbkdf2Hash(newHash func() hash.Hash, password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	hLen := prf.Size()
+
+	var dk []byte
+	for block := 1; len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+
+		t := make([]byte, hLen)
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(nil)
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+func (s *S) TestChannelBindingConversation(c *C) {
+	m, err := scram.NewMethod("SCRAM-SHA-256-PLUS")
+	c.Assert(err, IsNil)
+
+	cbData := []byte("fake-tls-server-end-point-hash")
+	client, err := scram.NewClientWithChannelBinding(m, "user", "pencil", "tls-server-end-point", cbData)
+	c.Assert(err, IsNil)
+
+	out, ok, err := client.Step(nil)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(strings.HasPrefix(string(out), "p=tls-server-end-point,,"), Equals, true)
+
+	server := newFakeServer("pencil")
+	server.expectCBind = append([]byte("p=tls-server-end-point,,"), cbData...)
+
+	serverFirst, err := server.firstResponse(string(out))
+	c.Assert(err, IsNil)
+
+	out, ok, err = client.Step([]byte(serverFirst))
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+
+	// finalResponse checks the "c=" attribute against server.expectCBind,
+	// so if Step ever regresses to sending "c=biws" (no channel binding)
+	// this fails right here instead of silently accepting it.
+	serverFinal, err := server.finalResponse(string(out))
+	c.Assert(err, IsNil)
+
+	_, ok, err = client.Step([]byte(serverFinal))
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	c.Assert(client.Err(), IsNil)
+}
+
+func (s *S) TestStepTable(c *C) {
+	newClient := func() *scram.Client {
+		m, err := scram.NewMethod("SCRAM-SHA-256")
+		c.Assert(err, IsNil)
+		client, err := scram.NewClient(m, "user", "pencil")
+		c.Assert(err, IsNil)
+		return client
+	}
+
+	c.Log("happy path: conversation completes with no error")
+	{
+		client := newClient()
+		server := newFakeServer("pencil")
+
+		out, ok, err := client.Step(nil)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		serverFirst, err := server.firstResponse(string(out))
+		c.Assert(err, IsNil)
+
+		out, ok, err = client.Step([]byte(serverFirst))
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		serverFinal, err := server.finalResponse(string(out))
+		c.Assert(err, IsNil)
+
+		out, ok, err = client.Step([]byte(serverFinal))
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, false)
+		c.Assert(client.Err(), IsNil)
+		c.Assert(client.Out(), DeepEquals, out)
+
+		c.Log("extra Step calls after completion are a no-op")
+		out, ok, err = client.Step([]byte("ignored"))
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, false)
+		c.Assert(out, IsNil)
+	}
+
+	c.Log("server-side auth failure surfaces as an error from Step")
+	{
+		client := newClient()
+		server := newFakeServer("pencil")
+
+		out, ok, err := client.Step(nil)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+
+		serverFirst, err := server.firstResponse(string(out))
+		c.Assert(err, IsNil)
+
+		out, ok, err = client.Step([]byte(serverFirst))
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+		_ = out
+
+		out, ok, err = client.Step([]byte("e=invalid-proof"))
+		c.Assert(err, NotNil)
+		c.Assert(ok, Equals, false)
+		c.Assert(out, IsNil)
+		c.Assert(client.Err(), Equals, err)
+	}
+
+	c.Log("malformed server nonce is rejected")
+	{
+		client := newClient()
+
+		out, ok, err := client.Step(nil)
+		c.Assert(err, IsNil)
+		c.Assert(ok, Equals, true)
+		_ = out
+
+		bogusFirst := "r=does-not-start-with-client-nonce,s=" + base64.StdEncoding.EncodeToString([]byte("salt")) + ",i=4096"
+		out, ok, err = client.Step([]byte(bogusFirst))
+		c.Assert(err, NotNil)
+		c.Assert(ok, Equals, false)
+		c.Assert(out, IsNil)
+	}
+}